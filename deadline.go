@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// deadlineTimer arms a timer that closes a cancel channel when it fires,
+// modeled on the cancel-channel pattern used by Go's netstack gonet adapter.
+// Callers select on Cancel() instead of blocking on time.Sleep, so a
+// deadline can be shortened, extended, or disarmed without leaking timers.
+type deadlineTimer struct {
+	mu       sync.Mutex
+	timer    *time.Timer
+	cancelCh chan struct{}
+}
+
+func newDeadlineTimer() *deadlineTimer {
+	return &deadlineTimer{cancelCh: make(chan struct{})}
+}
+
+// SetDeadline arms the timer to close the current cancel channel at t. A
+// zero t disarms it. Safe to call again to shorten or extend the deadline.
+func (d *deadlineTimer) SetDeadline(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// The timer already fired and closed cancelCh; arm the next wait
+		// with a fresh one.
+		d.cancelCh = make(chan struct{})
+	}
+
+	if t.IsZero() {
+		d.timer = nil
+		return
+	}
+
+	ch := d.cancelCh
+	d.timer = time.AfterFunc(time.Until(t), func() { close(ch) })
+}
+
+// Cancel returns the channel that closes when the current deadline expires.
+func (d *deadlineTimer) Cancel() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancelCh
+}
@@ -2,16 +2,20 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/hashgraph/hedera-sdk-go/v2"
@@ -26,6 +30,9 @@ type TransactionPayload struct {
 	Timestamp               string  `json:"currentTimestamp"`
 	EthereumTransactionHash *string `json:"ethereumTransactionHash"`
 	HederaTransactionHash   string  `json:"hederaTransactionHash"`
+	// MirrorPollDeadline optionally overrides MIRROR_POLL_DEADLINE for this
+	// transaction, e.g. "45s". Empty means use the server default.
+	MirrorPollDeadline string `json:"mirrorPollDeadline,omitempty"`
 }
 
 type TransactionStatus struct {
@@ -35,22 +42,32 @@ type TransactionStatus struct {
 }
 
 var (
-	port                 int
-	networkQueue         chan TransactionPayload
-	mirrorQueue          chan TransactionPayload
-	networkUrl           string
-	networkAccount       int
-	operatorAccount      int
-	operatorAccountKey   string
-	mirrorNodeUrl        string
-	shadowingApiUrl      string
-	fullLogFilePath      string
-	logFile              *os.File
-	networkWorkers       int
-	mirrorWorkers        int
-	networkQueueCapacity int
-	mirrorQueueCapacity  int
-	wg                   sync.WaitGroup
+	port                  int
+	networkQueue          DurableQueue
+	mirrorQueue           DurableQueue
+	networkUrl            string
+	networkAccount        int
+	operatorAccount       int
+	operatorAccountKey    string
+	mirrorNodeUrl         string
+	shadowingApiUrl       string
+	fullLogFilePath       string
+	logFile               *os.File
+	networkWorkers        int
+	mirrorWorkers         int
+	networkQueueCapacity  int
+	mirrorQueueCapacity   int
+	queueDir              string
+	networkQueueRetention time.Duration
+	mirrorQueueRetention  time.Duration
+	shutdownTimeout       time.Duration
+	mirrorPollInitial     time.Duration
+	mirrorPollMax         time.Duration
+	mirrorPollDeadline    time.Duration
+	readyHighWaterMark    float64
+	shadowingApiBreaker   *circuitBreaker
+	routingStrategy       RoutingStrategy
+	wg                    sync.WaitGroup
 
 	successStatusCodes = map[int]struct{}{
 		http.StatusOK:                   {},
@@ -75,6 +92,16 @@ func main() {
 	mirrorWorkers = getEnvAsInt("MIRROR_WORKERS", defaultNumWorkers)
 	networkQueueCapacity = getEnvAsInt("NETWORK_QUEUE_CAPACITY", defaultChannelCapacity)
 	mirrorQueueCapacity = getEnvAsInt("MIRROR_QUEUE_CAPACITY", defaultChannelCapacity)
+	queueDir = getEnv("QUEUE_DIR", "data/queues")
+	networkQueueRetention = getEnvAsDuration("NETWORK_QUEUE_RETENTION", 5*time.Minute)
+	mirrorQueueRetention = getEnvAsDuration("MIRROR_QUEUE_RETENTION", 5*time.Minute)
+	shutdownTimeout = getEnvAsDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+	mirrorPollInitial = getEnvAsDuration("MIRROR_POLL_INITIAL", 500*time.Millisecond)
+	mirrorPollMax = getEnvAsDuration("MIRROR_POLL_MAX", 30*time.Second)
+	mirrorPollDeadline = getEnvAsDuration("MIRROR_POLL_DEADLINE", 2*time.Minute)
+	readyHighWaterMark = getEnvAsFloat("QUEUE_READY_HIGH_WATER_MARK", 0.9)
+	shadowingApiBreaker = newCircuitBreaker(getEnvAsInt("SHADOWING_API_BREAKER_THRESHOLD", 5))
+	routingStrategy = newRoutingStrategy(getEnv("ROUTING_STRATEGY", "mirror-only"), getEnvAsDuration("MAX_TX_AGE", 3*time.Minute))
 	logFilePath := getEnv("LOG_FILE_PATH", "logs/")
 	logFileName := getEnv("LOG_FILE_NAME", "transactions.log")
 	fullLogFilePath := filepath.Join(logFilePath, logFileName)
@@ -86,10 +113,19 @@ func main() {
 	mirrorNodeUrl = getEnv("MIRROR_NODE_URL", "http://127.0.0.1:5551")
 	shadowingApiUrl = getEnv("SHADOWING_API_URL", "http://127.0.0.1:3005")
 
-	networkQueue = make(chan TransactionPayload, networkQueueCapacity)
-	mirrorQueue = make(chan TransactionPayload, mirrorQueueCapacity)
-
 	var err error
+	networkQueue, err = NewFileQueue("network", queueDir, networkQueueCapacity, networkQueueRetention)
+	if err != nil {
+		log.Fatalf("Failed to open network queue: %v", err)
+	}
+	defer networkQueue.Close()
+
+	mirrorQueue, err = NewFileQueue("mirror", queueDir, mirrorQueueCapacity, mirrorQueueRetention)
+	if err != nil {
+		log.Fatalf("Failed to open mirror queue: %v", err)
+	}
+	defer mirrorQueue.Close()
+
 	logFile, err = os.OpenFile(fullLogFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
 	if err != nil {
 		log.Fatalf("Failed to open log file: %v", err)
@@ -108,9 +144,30 @@ func main() {
 	nodeClient := hedera.ClientForNetwork(network)
 	defer nodeClient.Close()
 	nodeClient.SetOperator(operatorAccountID, privateKey)
+
+	// shutdownSignal fires the instant a shutdown signal is received, and
+	// only gates the HTTP server's Shutdown call and the queue-depth
+	// reporter. workCtx is separate and
+	// is not canceled until shutdownTimeout after that, so in-flight Hedera
+	// receipt queries, mirror polls, and shadowing-API calls get the full
+	// grace period to finish instead of being aborted immediately.
+	shutdownSignal, triggerShutdown := context.WithCancel(context.Background())
+	defer triggerShutdown()
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigCh
+		log.Printf("Received signal %v, shutting down", sig)
+		triggerShutdown()
+		time.AfterFunc(shutdownTimeout, cancelWork)
+	}()
+
 	for i := 0; i < networkWorkers; i++ {
 		wg.Add(1)
-		go hederaWorker(i, networkQueue, nodeClient)
+		go hederaWorker(workCtx, i, networkQueue, mirrorQueue, nodeClient)
 	}
 
 	mirrorClient := &http.Client{
@@ -118,86 +175,176 @@ func main() {
 	}
 	for i := 0; i < mirrorWorkers; i++ {
 		wg.Add(1)
-		go mirrorWorker(i, mirrorQueue, mirrorClient)
+		go mirrorWorker(workCtx, i, mirrorQueue, mirrorClient)
 	}
 
-	http.HandleFunc("/check-transaction", handleCheckTransaction)
+	go reportQueueDepths(shutdownSignal, 5*time.Second)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/check-transaction", handleCheckTransaction)
+	registerMetricsRoutes(mux)
 	address := fmt.Sprintf(":%d", port)
-	log.Printf("Listening on %s", address)
-	log.Fatal(http.ListenAndServe(address, nil))
+	server := &http.Server{Addr: address, Handler: mux}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("Listening on %s", address)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("HTTP server error: %v", err)
+		}
+	case <-shutdownSignal.Done():
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer shutdownCancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("HTTP server shutdown error: %v", err)
+		}
+	}
 
+	networkQueue.CloseChannel()
+	mirrorQueue.CloseChannel()
 	wg.Wait()
 }
 
 func handleCheckTransaction(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
+		transactionsRejected.WithLabelValues("invalid_method").Inc()
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
 
 	var payload TransactionPayload
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		transactionsRejected.WithLabelValues("invalid_payload").Inc()
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
 
-	// timestamp, err := time.Parse(time.RFC3339, payload.Timestamp)
-	// if err != nil {
-	// 	http.Error(w, "Invalid timestamp format", http.StatusBadRequest)
-	// 	return
-	// }
-	// txTimestamp, err := time.Parse(time.RFC3339, payload.TxTimestamp)
-	// if err != nil {
-	// 	http.Error(w, "Invalid timestamp format", http.StatusBadRequest)
-	// 	return
-	// }
-
-	//if tooLate(timestamp, txTimestamp) {
-	//	mirrorQueue <- payload
-	//	log.Printf("Transaction %s sent directly to mirror queue due to old timestamp.", payload.TxID)
-	//} else {
-	//	networkQueue <- payload
-	//	log.Printf("Transaction %s sent to network node queue.", payload.TxID)
-	//}
-
-	mirrorQueue <- payload
-	log.Printf("Transaction %s sent to mirror queue.", payload.TxID)
+	if err := routingStrategy.Route(payload); err != nil {
+		var validationErr *routingValidationError
+		if errors.As(err, &validationErr) {
+			transactionsRejected.WithLabelValues("invalid_timestamp").Inc()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		transactionsRejected.WithLabelValues("enqueue_failed").Inc()
+		log.Printf("Failed to route transaction %s: %v", payload.TxID, err)
+		http.Error(w, "Failed to accept transaction", http.StatusInternalServerError)
+		return
+	}
+
+	transactionsAccepted.Inc()
 	w.WriteHeader(http.StatusAccepted)
 	w.Write([]byte("OK"))
 }
 
-func hederaWorker(id int, payloads <-chan TransactionPayload, client *hedera.Client) {
+func hederaWorker(ctx context.Context, id int, queue DurableQueue, mirror DurableQueue, client *hedera.Client) {
 	defer wg.Done()
-	for payload := range payloads {
+	for payload := range queue.Channel() {
 		log.Printf("Hedera Worker %d processing transaction %s", id, payload.TxID)
-		status, err := getTransactionReceiptFromHederaNode(client, payload)
+		receiptStart := time.Now()
+		status, err := getTransactionReceiptFromHederaNode(ctx, client, payload)
+		hederaReceiptDuration.Observe(time.Since(receiptStart).Seconds())
 		if err != nil {
-			mirrorQueue <- payload
+			if enqErr := mirror.Enqueue(payload); enqErr != nil {
+				log.Printf("Hedera Worker %d failed to re-enqueue transaction %s on mirror queue, leaving it pending: %v", id, payload.TxID, enqErr)
+				continue
+			}
+			mirrorFallbackTotal.Inc()
 			log.Printf("Hedera Worker %d failed to get receipt of transaction %s, sent to mirror queue. Error was: %v", id, payload.TxID, err)
-		} else {
-			log.Printf("Status of transaction %s is: %s", payload.TxID, status.String())
-			sendAndLogToFile(payload, status.String(), nil)
+			// The entry now lives durably in the mirror queue's own WAL, so
+			// it is done here regardless of how the mirror worker's attempt
+			// to process it eventually goes.
+			if err := queue.MarkDone(payload); err != nil {
+				log.Printf("Hedera Worker %d failed to mark transaction %s done: %v", id, payload.TxID, err)
+			}
+			continue
+		}
+
+		log.Printf("Status of transaction %s is: %s", payload.TxID, status.String())
+		if sendErr := sendAndLogToFile(ctx, payload, status.String(), nil); sendErr != nil {
+			log.Printf("Hedera Worker %d: leaving transaction %s pending, shadowing API send failed: %v", id, payload.TxID, sendErr)
+			continue
+		}
+		if err := queue.MarkDone(payload); err != nil {
+			log.Printf("Hedera Worker %d failed to mark transaction %s done: %v", id, payload.TxID, err)
 		}
 	}
 }
 
-func mirrorWorker(id int, payloads <-chan TransactionPayload, client *http.Client) {
+func mirrorWorker(ctx context.Context, id int, queue DurableQueue, client *http.Client) {
 	defer wg.Done()
-	for payload := range payloads {
+	for payload := range queue.Channel() {
 		log.Printf("Mirror Worker %d processing transaction %s", id, payload.TxID)
-		time.Sleep(2 * time.Second)
-		status, err := checkTransactionOnMirrorNode(client, payload)
+		status, err := pollMirrorNode(ctx, client, payload)
+		var sendErr error
 		if err != nil {
 			log.Printf("Mirror Worker %d failed to get the status of transaction %s from the mirror node: %v", id, payload.TxID, err)
-			sendAndLogToFile(payload, "", fmt.Errorf("error getting status fgrom node, transaction failed or not executed (mirror node): %v", err))
+			sendErr = sendAndLogToFile(ctx, payload, "", fmt.Errorf("error getting status fgrom node, transaction failed or not executed (mirror node): %v", err))
 		} else {
 			log.Printf("Status of transaction %s is: %s", payload.TxID, status)
-			sendAndLogToFile(payload, status, nil)
+			sendErr = sendAndLogToFile(ctx, payload, status, nil)
+		}
+		if sendErr != nil {
+			log.Printf("Mirror Worker %d: leaving transaction %s pending, shadowing API send failed: %v", id, payload.TxID, sendErr)
+			continue
+		}
+		if err := queue.MarkDone(payload); err != nil {
+			log.Printf("Mirror Worker %d failed to mark transaction %s done: %v", id, payload.TxID, err)
+		}
+	}
+}
+
+// pollMirrorNode repeatedly calls checkTransactionOnMirrorNode with
+// exponential backoff (mirrorPollInitial doubling up to mirrorPollMax) until
+// the transaction shows up, the per-transaction deadline expires, or ctx is
+// canceled. payload.MirrorPollDeadline lets a caller shorten or extend that
+// deadline for a single transaction.
+func pollMirrorNode(ctx context.Context, client *http.Client, payload TransactionPayload) (string, error) {
+	deadline := mirrorPollDeadline
+	if payload.MirrorPollDeadline != "" {
+		if d, err := time.ParseDuration(payload.MirrorPollDeadline); err == nil {
+			deadline = d
+		} else {
+			log.Printf("Invalid mirrorPollDeadline %q for transaction %s, using default: %v", payload.MirrorPollDeadline, payload.TxID, err)
+		}
+	}
+
+	dt := newDeadlineTimer()
+	dt.SetDeadline(time.Now().Add(deadline))
+	defer dt.SetDeadline(time.Time{})
+
+	backoff := mirrorPollInitial
+	for {
+		lookupStart := time.Now()
+		status, err := checkTransactionOnMirrorNode(ctx, client, payload)
+		mirrorLookupDuration.Observe(time.Since(lookupStart).Seconds())
+		if err != nil {
+			log.Printf("checkTransactionOnMirrorNode: lookup for transaction %s failed, retrying: %v", payload.TxID, err)
+		} else if status != "" {
+			return status, nil
+		}
+
+		select {
+		case <-dt.Cancel():
+			return "", fmt.Errorf("mirror poll deadline of %s exceeded for transaction %s", deadline, payload.TxID)
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > mirrorPollMax {
+			backoff = mirrorPollMax
 		}
 	}
 }
 
-func getTransactionReceiptFromHederaNode(client *hedera.Client, payload TransactionPayload) (hedera.Status, error) {
+func getTransactionReceiptFromHederaNode(ctx context.Context, client *hedera.Client, payload TransactionPayload) (hedera.Status, error) {
 
 	transactionId, err := hedera.TransactionIdFromString(payload.TxID)
 	if err != nil {
@@ -206,7 +353,7 @@ func getTransactionReceiptFromHederaNode(client *hedera.Client, payload Transact
 
 	receipt, err := hedera.NewTransactionReceiptQuery().
 		SetTransactionID(transactionId).
-		Execute(client)
+		ExecuteWithContext(ctx, client)
 	if err != nil {
 		return hedera.StatusUnknown, err
 	}
@@ -215,7 +362,7 @@ func getTransactionReceiptFromHederaNode(client *hedera.Client, payload Transact
 	return receipt.Status, nil
 }
 
-func checkTransactionOnMirrorNode(client *http.Client, payload TransactionPayload) (string, error) {
+func checkTransactionOnMirrorNode(ctx context.Context, client *http.Client, payload TransactionPayload) (string, error) {
 	type Transaction struct {
 		Result        string `json:"result"`
 		TransactionID string `json:"transaction_id"`
@@ -229,7 +376,11 @@ func checkTransactionOnMirrorNode(client *http.Client, payload TransactionPayloa
 
 	url := mirrorNodeUrl + "/api/v1/transactions/" + transactionId
 	log.Printf("checkTransactionOnMirrorNode: Sending GET request to: %s", url)
-	resp, err := client.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -243,7 +394,7 @@ func checkTransactionOnMirrorNode(client *http.Client, payload TransactionPayloa
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatalf("Error reading response body: %v", err)
+		return "", fmt.Errorf("reading response body: %w", err)
 	}
 	var response Response
 	if err := json.Unmarshal(body, &response); err != nil {
@@ -261,58 +412,84 @@ func checkTransactionOnMirrorNode(client *http.Client, payload TransactionPayloa
 	return result, nil
 }
 
-func sendAndLogToFile(payload TransactionPayload, status string, error error) {
+// sendAndLogToFile reports a processed transaction to the shadowing API and
+// appends it to the log file. It returns the shadowingApi error (nil on
+// success) so callers can decide whether the transaction is actually done;
+// a logToFile failure is only logged, since it does not affect durability.
+func sendAndLogToFile(ctx context.Context, payload TransactionPayload, status string, procErr error) error {
 	transactionStatus := TransactionStatus{
 		TransactionPayload: payload,
 		Status:             status,
 	}
-	if error != nil {
-		transactionStatus.Error = error.Error()
+	if procErr != nil {
+		transactionStatus.Error = procErr.Error()
 	}
 	jsonBytes, err := json.Marshal(transactionStatus)
 	if err != nil {
 		log.Printf("Error marshaling transaction %s to JSON: %v", payload.TxID, err)
-		return
+		return err
 	}
 
-	err = sendToShadowingApi(jsonBytes)
-	if err != nil {
-		log.Printf("Error sending the transaction: %v", err)
+	sendErr := sendToShadowingApi(ctx, jsonBytes)
+	if sendErr != nil {
+		log.Printf("Error sending the transaction: %v", sendErr)
 	}
 
-	err = logToFile(jsonBytes)
-	if err != nil {
+	if err := logToFile(ctx, jsonBytes); err != nil {
 		log.Printf("Failed to log transaction: %v", err)
 	}
+
+	return sendErr
 }
 
-func sendToShadowingApi(jsonBytes []byte) error {
+func sendToShadowingApi(ctx context.Context, jsonBytes []byte) error {
 	url := shadowingApiUrl + "/contract-value"
 	log.Printf("sendToShadowingApi: Sending POST request to: %s", url)
 	log.Println("Request data:")
 	logPrettyJSON(jsonBytes)
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonBytes))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(jsonBytes))
 	if err != nil {
+		return fmt.Errorf("error building request to Shadowing API: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		shadowingApiFailures.WithLabelValues(shadowingApiFailureLabel(0)).Inc()
+		shadowingApiBreaker.recordResult(err)
 		return fmt.Errorf("error sending data to Shadowing API: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if _, ok := successStatusCodes[resp.StatusCode]; ok {
 		log.Printf("OK (%d)", resp.StatusCode)
+		shadowingApiBreaker.recordResult(nil)
 		return nil
 	} else {
-		return fmt.Errorf("error sending data to Shadowing API. Request failed with status code: %d", resp.StatusCode)
+		shadowingApiFailures.WithLabelValues(shadowingApiFailureLabel(resp.StatusCode)).Inc()
+		err := fmt.Errorf("error sending data to Shadowing API. Request failed with status code: %d", resp.StatusCode)
+		shadowingApiBreaker.recordResult(err)
+		return err
 	}
 
 }
 
-func logToFile(jsonBytes []byte) error {
+func logToFile(ctx context.Context, jsonBytes []byte) error {
 	logEntry := time.Now().Format(time.RFC3339) + " - " + string(jsonBytes) + "\n"
-	var _, err = logFile.WriteString(logEntry)
-	if err != nil {
-		return fmt.Errorf("failed to write to log file: %v", err)
+	done := make(chan error, 1)
+	go func() {
+		_, err := logFile.WriteString(logEntry)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("failed to write to log file: %v", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("log write aborted during shutdown: %w", ctx.Err())
 	}
-	return nil
 }
 
 func logPrettyJSON(jsonData []byte) {
@@ -349,6 +526,32 @@ func getEnvAsInt(key string, defaultValue int) int {
 	return value
 }
 
+func getEnvAsFloat(key string, defaultValue float64) float64 {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return defaultValue
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		log.Printf("Invalid value for %s, using default: %v", key, defaultValue)
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return defaultValue
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil {
+		log.Printf("Invalid value for %s, using default: %v", key, defaultValue)
+		return defaultValue
+	}
+	return value
+}
+
 func convertTransactionIdForMirrorNode(input string) string {
 	re := regexp.MustCompile(`@([^.]*)\.`)
 	result := re.ReplaceAllStringFunc(input, func(s string) string {
@@ -356,9 +559,3 @@ func convertTransactionIdForMirrorNode(input string) string {
 	})
 	return result
 }
-
-func tooLate(timestamp time.Time, txTimestamp time.Time) bool {
-	timeDifference := time.Since(timestamp)
-	adjustedTxTimestamp := txTimestamp.Add(timeDifference)
-	return adjustedTxTimestamp.Sub(txTimestamp) > 3*time.Minute
-}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	networkQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "transaction_checker_network_queue_depth",
+		Help: "Current number of payloads buffered in the network queue channel.",
+	})
+	networkQueueCapacityGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "transaction_checker_network_queue_capacity",
+		Help: "Configured capacity of the network queue channel.",
+	})
+	mirrorQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "transaction_checker_mirror_queue_depth",
+		Help: "Current number of payloads buffered in the mirror queue channel.",
+	})
+	mirrorQueueCapacityGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "transaction_checker_mirror_queue_capacity",
+		Help: "Configured capacity of the mirror queue channel.",
+	})
+
+	transactionsAccepted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "transaction_checker_transactions_accepted_total",
+		Help: "Transactions accepted by /check-transaction.",
+	})
+	transactionsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "transaction_checker_transactions_rejected_total",
+		Help: "Transactions rejected by /check-transaction, by reason.",
+	}, []string{"reason"})
+
+	hederaReceiptDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "transaction_checker_hedera_receipt_duration_seconds",
+		Help:    "Latency of getTransactionReceiptFromHederaNode calls.",
+		Buckets: prometheus.DefBuckets,
+	})
+	mirrorLookupDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "transaction_checker_mirror_lookup_duration_seconds",
+		Help:    "Latency of individual checkTransactionOnMirrorNode attempts.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	shadowingApiFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "transaction_checker_shadowing_api_failures_total",
+		Help: "Failed sendToShadowingApi calls, by response status code (or \"network_error\").",
+	}, []string{"status_code"})
+
+	mirrorFallbackTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "transaction_checker_mirror_fallback_total",
+		Help: "Transactions routed from the network queue to the mirror queue after a failed receipt lookup.",
+	})
+)
+
+// circuitBreaker trips open after a configurable number of consecutive
+// sendToShadowingApi failures, so /readyz can report the instance unready
+// while the shadowing API is unreachable instead of failing silently.
+type circuitBreaker struct {
+	mu                  sync.Mutex
+	threshold           int
+	consecutiveFailures int
+}
+
+func newCircuitBreaker(threshold int) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold}
+}
+
+func (c *circuitBreaker) recordResult(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.consecutiveFailures++
+	} else {
+		c.consecutiveFailures = 0
+	}
+}
+
+func (c *circuitBreaker) open() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.consecutiveFailures >= c.threshold
+}
+
+// reportQueueDepths periodically samples the queue channels' length and
+// capacity into gauges until ctx is canceled. Channel length can only be
+// observed by polling, so this runs on a short tick rather than being
+// pushed from Enqueue/MarkDone.
+func reportQueueDepths(ctx context.Context, interval time.Duration) {
+	networkQueueCapacityGauge.Set(float64(cap(networkQueue.Channel())))
+	mirrorQueueCapacityGauge.Set(float64(cap(mirrorQueue.Channel())))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			networkQueueDepth.Set(float64(len(networkQueue.Channel())))
+			mirrorQueueDepth.Set(float64(len(mirrorQueue.Channel())))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleHealthz is a liveness probe: it only reports that the process is up
+// and serving requests.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// handleReadyz is a readiness probe: it fails once either queue's occupancy
+// crosses readyHighWaterMark of its capacity, or once the shadowing API
+// circuit breaker has tripped, so a load balancer can stop sending traffic
+// to an instance that is backing up or can no longer shadow transactions.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if occupancy(networkQueue.Channel()) > readyHighWaterMark {
+		http.Error(w, "network queue occupancy above high-water mark", http.StatusServiceUnavailable)
+		return
+	}
+	if occupancy(mirrorQueue.Channel()) > readyHighWaterMark {
+		http.Error(w, "mirror queue occupancy above high-water mark", http.StatusServiceUnavailable)
+		return
+	}
+	if shadowingApiBreaker.open() {
+		http.Error(w, "shadowing API circuit breaker open", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+func occupancy(ch chan TransactionPayload) float64 {
+	if cap(ch) == 0 {
+		return 0
+	}
+	return float64(len(ch)) / float64(cap(ch))
+}
+
+func shadowingApiFailureLabel(statusCode int) string {
+	if statusCode == 0 {
+		return "network_error"
+	}
+	return strconv.Itoa(statusCode)
+}
+
+func registerMetricsRoutes(mux *http.ServeMux) {
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+}
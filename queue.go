@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DurableQueue is a crash-safe queue of TransactionPayload entries. Entries
+// are durable on disk before Enqueue returns, and are replayed into Channel
+// on startup if they were never marked done by a worker.
+type DurableQueue interface {
+	// Enqueue appends payload to the write-ahead log, fsyncs it, and only
+	// then hands it to Channel, so a payload ACKed to a caller is never
+	// lost to a crash before a worker claims it.
+	Enqueue(payload TransactionPayload) error
+	// MarkDone records payload as fully processed so it is not replayed on
+	// the next startup.
+	MarkDone(payload TransactionPayload) error
+	// Channel is the in-memory channel workers range over.
+	Channel() chan TransactionPayload
+	// CloseChannel closes Channel so workers finish their range loop once
+	// they have drained whatever is left in it. Enqueue must not be called
+	// after this.
+	CloseChannel()
+	// Close stops background compaction and flushes the WAL to disk.
+	Close() error
+}
+
+// walEntry is a single record appended to a queue's write-ahead log.
+type walEntry struct {
+	Payload TransactionPayload `json:"payload"`
+}
+
+// FileQueue is a DurableQueue backed by a length-prefixed append-only log
+// file, one per queue, under QUEUE_DIR. A background goroutine periodically
+// compacts the log down to only the entries still pending.
+type FileQueue struct {
+	name      string
+	dir       string
+	ch        chan TransactionPayload
+	retention time.Duration
+
+	mu      sync.Mutex
+	walFile *os.File
+	pending map[string]TransactionPayload // TxID -> payload, not yet done
+	closed  chan struct{}
+	closing bool
+	sendWG  sync.WaitGroup // in-flight Enqueue sends on ch
+}
+
+// NewFileQueue opens (or creates) the WAL for name under dir, and starts
+// background goroutines to replay any entries left over from a previous
+// run into its channel and to periodically compact the WAL. Replay runs in
+// the background (rather than before returning) so a backlog bigger than
+// capacity can't hang NewFileQueue waiting for channel room.
+func NewFileQueue(name, dir string, capacity int, retention time.Duration) (*FileQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating queue dir %s: %w", dir, err)
+	}
+
+	q := &FileQueue{
+		name:      name,
+		dir:       dir,
+		ch:        make(chan TransactionPayload, capacity),
+		retention: retention,
+		pending:   make(map[string]TransactionPayload),
+		closed:    make(chan struct{}),
+	}
+
+	existing, err := readWALEntries(q.walPath())
+	if err != nil {
+		return nil, fmt.Errorf("replaying %s queue WAL: %w", name, err)
+	}
+	for _, e := range existing {
+		q.pending[e.Payload.TxID] = e.Payload
+	}
+
+	walFile, err := os.OpenFile(q.walPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s queue WAL: %w", name, err)
+	}
+	q.walFile = walFile
+
+	go q.replayPending()
+	go q.compactLoop()
+
+	return q, nil
+}
+
+// replayPending sends every entry left pending from the WAL onto ch in the
+// background. It runs as its own goroutine instead of inline in
+// NewFileQueue so a backlog larger than capacity blocks only this
+// goroutine rather than hanging NewFileQueue (and therefore main, before
+// the HTTP server has even started) until a worker drains enough room.
+func (q *FileQueue) replayPending() {
+	q.mu.Lock()
+	toReplay := make([]TransactionPayload, 0, len(q.pending))
+	for _, payload := range q.pending {
+		toReplay = append(toReplay, payload)
+	}
+	q.mu.Unlock()
+
+	if len(toReplay) > 0 {
+		log.Printf("%s queue: replaying %d unfinished entries from WAL", q.name, len(toReplay))
+	}
+
+	for _, payload := range toReplay {
+		q.mu.Lock()
+		if q.closing {
+			q.mu.Unlock()
+			return
+		}
+		q.sendWG.Add(1)
+		q.mu.Unlock()
+
+		q.ch <- payload
+		q.sendWG.Done()
+	}
+}
+
+func (q *FileQueue) walPath() string {
+	return filepath.Join(q.dir, q.name+".wal")
+}
+
+// Channel returns the in-memory channel workers range over.
+func (q *FileQueue) Channel() chan TransactionPayload {
+	return q.ch
+}
+
+// CloseChannel marks the queue as closing, rejecting any Enqueue call that
+// hasn't already started, waits for in-flight Enqueue sends on Channel to
+// complete, and only then closes it. This guarantees no send on Channel can
+// ever race a close of it.
+func (q *FileQueue) CloseChannel() {
+	q.mu.Lock()
+	q.closing = true
+	q.mu.Unlock()
+
+	q.sendWG.Wait()
+	close(q.ch)
+}
+
+// Enqueue appends payload to the WAL, fsyncs it, and only then delivers it
+// to Channel. It fails fast once CloseChannel has been called instead of
+// risking a send on a channel that is being (or has been) closed.
+func (q *FileQueue) Enqueue(payload TransactionPayload) error {
+	q.mu.Lock()
+	if q.closing {
+		q.mu.Unlock()
+		return fmt.Errorf("%s queue is shutting down, rejecting enqueue of transaction %s", q.name, payload.TxID)
+	}
+	if err := q.appendLocked(payload); err != nil {
+		q.mu.Unlock()
+		return err
+	}
+	q.pending[payload.TxID] = payload
+	q.sendWG.Add(1)
+	q.mu.Unlock()
+	defer q.sendWG.Done()
+
+	q.ch <- payload
+	return nil
+}
+
+func (q *FileQueue) appendLocked(payload TransactionPayload) error {
+	data, err := json.Marshal(walEntry{Payload: payload})
+	if err != nil {
+		return fmt.Errorf("marshaling WAL entry: %w", err)
+	}
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+	if _, err := q.walFile.Write(header); err != nil {
+		return fmt.Errorf("writing WAL entry: %w", err)
+	}
+	if _, err := q.walFile.Write(data); err != nil {
+		return fmt.Errorf("writing WAL entry: %w", err)
+	}
+	return q.walFile.Sync()
+}
+
+// MarkDone removes payload from the pending set. It takes effect on the
+// next compaction pass rather than rewriting the log synchronously, so it
+// stays cheap on the hot path.
+func (q *FileQueue) MarkDone(payload TransactionPayload) error {
+	q.mu.Lock()
+	delete(q.pending, payload.TxID)
+	q.mu.Unlock()
+	return nil
+}
+
+// compactLoop periodically rewrites the WAL to contain only still-pending
+// entries, so the log does not grow without bound.
+func (q *FileQueue) compactLoop() {
+	ticker := time.NewTicker(q.retention)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.mu.Lock()
+			if err := q.rewriteWALLocked(); err != nil {
+				log.Printf("%s queue: compaction failed: %v", q.name, err)
+			}
+			q.mu.Unlock()
+		case <-q.closed:
+			return
+		}
+	}
+}
+
+// rewriteWALLocked atomically replaces the WAL file with one containing only
+// the currently pending entries. Callers must hold q.mu.
+func (q *FileQueue) rewriteWALLocked() error {
+	tmpPath := q.walPath() + ".compact"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("creating compaction file: %w", err)
+	}
+
+	for _, payload := range q.pending {
+		data, err := json.Marshal(walEntry{Payload: payload})
+		if err != nil {
+			tmpFile.Close()
+			return fmt.Errorf("marshaling WAL entry during compaction: %w", err)
+		}
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint32(header, uint32(len(data)))
+		if _, err := tmpFile.Write(header); err != nil {
+			tmpFile.Close()
+			return fmt.Errorf("writing compacted WAL entry: %w", err)
+		}
+		if _, err := tmpFile.Write(data); err != nil {
+			tmpFile.Close()
+			return fmt.Errorf("writing compacted WAL entry: %w", err)
+		}
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("syncing compaction file: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("closing compaction file: %w", err)
+	}
+
+	if err := q.walFile.Close(); err != nil {
+		return fmt.Errorf("closing WAL before compaction swap: %w", err)
+	}
+	if err := os.Rename(tmpPath, q.walPath()); err != nil {
+		return fmt.Errorf("swapping compacted WAL into place: %w", err)
+	}
+	walFile, err := os.OpenFile(q.walPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("reopening WAL after compaction: %w", err)
+	}
+	q.walFile = walFile
+	return nil
+}
+
+// Close stops the compaction goroutine and compacts the WAL one last time
+// before flushing it, so entries already marked done by MarkDone are not
+// replayed on the next startup just because the periodic compactLoop tick
+// hadn't run yet (MarkDone itself only updates the in-memory pending set).
+func (q *FileQueue) Close() error {
+	close(q.closed)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.rewriteWALLocked(); err != nil {
+		return fmt.Errorf("compacting %s queue WAL on close: %w", q.name, err)
+	}
+	return q.walFile.Close()
+}
+
+// readWALEntries reads every length-prefixed record from path. A missing
+// file is treated as an empty WAL; a short or corrupt trailing record means
+// the process crashed mid-write, so replay simply stops there.
+func readWALEntries(path string) ([]walEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []walEntry
+	reader := bufio.NewReader(f)
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(reader, data); err != nil {
+			break
+		}
+		var entry walEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
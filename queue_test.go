@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFileQueueReplaysUnfinishedEntriesAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	q, err := NewFileQueue("test", dir, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("NewFileQueue: %v", err)
+	}
+
+	payload := TransactionPayload{TxID: "0.0.100@1700000000.000000000"}
+	if err := q.Enqueue(payload); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	<-q.Channel() // simulate a worker claiming the entry without finishing it
+
+	if err := q.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	q2, err := NewFileQueue("test", dir, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("NewFileQueue (restart): %v", err)
+	}
+	defer q2.Close()
+
+	select {
+	case replayed := <-q2.Channel():
+		if replayed.TxID != payload.TxID {
+			t.Fatalf("replayed wrong payload: %+v", replayed)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the unfinished entry to be replayed after restart")
+	}
+}
+
+func TestFileQueueDoesNotReplayDoneEntriesAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	q, err := NewFileQueue("test", dir, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("NewFileQueue: %v", err)
+	}
+
+	payload := TransactionPayload{TxID: "0.0.100@1700000000.000000000"}
+	if err := q.Enqueue(payload); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	<-q.Channel()
+	if err := q.MarkDone(payload); err != nil {
+		t.Fatalf("MarkDone: %v", err)
+	}
+
+	// Close, not a crash: this exercises the compaction Close does on a
+	// clean shutdown, before the periodic compactLoop tick would have run.
+	if err := q.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	q2, err := NewFileQueue("test", dir, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("NewFileQueue (restart): %v", err)
+	}
+	defer q2.Close()
+
+	select {
+	case replayed := <-q2.Channel():
+		t.Fatalf("did not expect a completed entry to be replayed, got %+v", replayed)
+	default:
+	}
+}
+
+func TestFileQueueEnqueueRejectsOnceChannelIsClosing(t *testing.T) {
+	dir := t.TempDir()
+
+	q, err := NewFileQueue("test", dir, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("NewFileQueue: %v", err)
+	}
+	defer q.Close()
+
+	q.CloseChannel()
+
+	if err := q.Enqueue(TransactionPayload{TxID: "late"}); err == nil {
+		t.Fatalf("expected Enqueue to fail once the channel is closing")
+	}
+}
+
+func TestFileQueueReplayLargerThanCapacityDoesNotHangStartup(t *testing.T) {
+	dir := t.TempDir()
+
+	q, err := NewFileQueue("test", dir, 2, time.Hour)
+	if err != nil {
+		t.Fatalf("NewFileQueue: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := q.Enqueue(TransactionPayload{TxID: fmt.Sprintf("tx-%d", i)}); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+	}
+	// Leave both entries unclaimed and unfinished, simulating a crash with a
+	// backlog as large as the live channel's capacity.
+	if err := q.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	done := make(chan struct{})
+	var q2 *FileQueue
+	go func() {
+		var err error
+		q2, err = NewFileQueue("test", dir, 1, time.Hour)
+		if err != nil {
+			t.Errorf("NewFileQueue (restart): %v", err)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("NewFileQueue hung replaying a backlog larger than its channel capacity")
+	}
+	defer q2.Close()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// routingValidationError marks a RoutingStrategy.Route failure as caused by
+// bad input (e.g. an unparseable timestamp) rather than a downstream queue
+// failure, so handleCheckTransaction can answer with 400 instead of 500.
+type routingValidationError struct {
+	msg string
+}
+
+func (e *routingValidationError) Error() string { return e.msg }
+
+// RoutingStrategy decides which queue a freshly validated TransactionPayload
+// is sent to.
+type RoutingStrategy interface {
+	Route(payload TransactionPayload) error
+}
+
+// mirrorOnlyStrategy always routes through the mirror queue. This is the
+// behavior the handler had before routing strategies existed.
+type mirrorOnlyStrategy struct{}
+
+func (mirrorOnlyStrategy) Route(payload TransactionPayload) error {
+	if err := mirrorQueue.Enqueue(payload); err != nil {
+		return err
+	}
+	log.Printf("Transaction %s sent to mirror queue.", payload.TxID)
+	return nil
+}
+
+// networkFirstStrategy always routes through the network queue; hederaWorker
+// already falls back to the mirror queue itself if the receipt lookup fails.
+type networkFirstStrategy struct{}
+
+func (networkFirstStrategy) Route(payload TransactionPayload) error {
+	if err := networkQueue.Enqueue(payload); err != nil {
+		return err
+	}
+	log.Printf("Transaction %s sent to network node queue.", payload.TxID)
+	return nil
+}
+
+// ageBasedStrategy routes a transaction straight to the mirror queue once it
+// is older than maxAge, and to the network queue otherwise.
+type ageBasedStrategy struct {
+	maxAge time.Duration
+}
+
+func (s ageBasedStrategy) Route(payload TransactionPayload) error {
+	timestamp, err := parseTimestamp(payload.Timestamp)
+	if err != nil {
+		return &routingValidationError{msg: fmt.Sprintf("invalid currentTimestamp: %v", err)}
+	}
+	txTimestamp, err := parseTimestamp(payload.TxTimestamp)
+	if err != nil {
+		return &routingValidationError{msg: fmt.Sprintf("invalid txTimestamp: %v", err)}
+	}
+
+	if tooLate(timestamp, txTimestamp, s.maxAge) {
+		if err := mirrorQueue.Enqueue(payload); err != nil {
+			return err
+		}
+		log.Printf("Transaction %s sent directly to mirror queue due to old timestamp.", payload.TxID)
+		return nil
+	}
+
+	if err := networkQueue.Enqueue(payload); err != nil {
+		return err
+	}
+	log.Printf("Transaction %s sent to network node queue.", payload.TxID)
+	return nil
+}
+
+// parseTimestamp accepts both time.RFC3339 and time.RFC3339Nano.
+func parseTimestamp(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// tooLate reports whether txTimestamp is older than maxAge as observed at
+// timestamp. timestamp.Sub(txTimestamp) is the server-side age of the
+// transaction at the moment it was received.
+func tooLate(timestamp time.Time, txTimestamp time.Time, maxAge time.Duration) bool {
+	return timestamp.Sub(txTimestamp) > maxAge
+}
+
+// newRoutingStrategy selects a RoutingStrategy by name, as read from
+// ROUTING_STRATEGY. Unknown names fall back to mirror-only, the strategy
+// the handler used before ROUTING_STRATEGY existed.
+func newRoutingStrategy(name string, maxAge time.Duration) RoutingStrategy {
+	switch name {
+	case "network-first":
+		return networkFirstStrategy{}
+	case "age-based":
+		return ageBasedStrategy{maxAge: maxAge}
+	case "mirror-only", "":
+		return mirrorOnlyStrategy{}
+	default:
+		log.Printf("Unknown ROUTING_STRATEGY %q, defaulting to mirror-only", name)
+		return mirrorOnlyStrategy{}
+	}
+}
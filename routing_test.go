@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTooLate(t *testing.T) {
+	base, err := time.Parse(time.RFC3339, "2026-01-01T00:00:00Z")
+	if err != nil {
+		t.Fatalf("parsing base time: %v", err)
+	}
+	maxAge := 5 * time.Minute
+
+	cases := []struct {
+		name        string
+		txTimestamp time.Time
+		want        bool
+	}{
+		{"fresh", base, false},
+		{"just under maxAge", base.Add(-maxAge + time.Second), false},
+		{"exactly maxAge", base.Add(-maxAge), false},
+		{"over maxAge", base.Add(-maxAge - time.Second), true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := tooLate(base, c.txTimestamp, maxAge); got != c.want {
+				t.Errorf("tooLate(%v, %v, %v) = %v, want %v", base, c.txTimestamp, maxAge, got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	cases := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{"RFC3339", "2026-01-01T00:00:00Z", false},
+		{"RFC3339Nano", "2026-01-01T00:00:00.123456789Z", false},
+		{"malformed", "not-a-timestamp", true},
+		{"empty", "", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := parseTimestamp(c.value)
+			if (err != nil) != c.wantErr {
+				t.Errorf("parseTimestamp(%q) error = %v, wantErr %v", c.value, err, c.wantErr)
+			}
+		})
+	}
+}